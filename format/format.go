@@ -0,0 +1,50 @@
+// Package format loads tracker modules from any of several on-disk formats (MOD, S3M, XM) into
+// a tracker.Modfile, by detecting which format a file is in and handing it off to the matching
+// Loader.
+package format
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/fohristiwhirl/mod_to_wav/tracker"
+)
+
+// Loader recognises and parses one on-disk module format.
+
+type Loader interface {
+	Detect(r io.ReaderAt) bool
+	Load(r io.Reader) (*tracker.Modfile, error)
+}
+
+// loaders is tried in order. modLoader is listed last and accepts anything the others don't,
+// since old-style 15-instrument MODs carry no identifying tag at all.
+
+var loaders = []Loader{
+	xmLoader{},
+	s3mLoader{},
+	modLoader{},
+}
+
+// LoadFile detects which registered Loader recognises f, then uses it to parse the whole file.
+
+func LoadFile(f *os.File) (*tracker.Modfile, error) {
+
+	for i, loader := range loaders {
+
+		last := i == len(loaders) - 1
+
+		if loader.Detect(f) || last {
+
+			_, err := f.Seek(0, 0)
+			if err != nil {
+				return nil, fmt.Errorf("LoadFile: %v", err)
+			}
+
+			return loader.Load(f)
+		}
+	}
+
+	return nil, fmt.Errorf("LoadFile: unrecognised module format")		// Unreachable; modLoader always matches last.
+}
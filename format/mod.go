@@ -0,0 +1,382 @@
+package format
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/fohristiwhirl/mod_to_wav/tracker"
+)
+
+// modLoader loads classic 15/31-instrument Amiga MOD files, including the common 4/6/8-channel
+// variants identified by a 4 byte tag at offset 1080.
+
+type modLoader struct{}
+
+func (modLoader) Detect(r io.ReaderAt) bool {
+
+	tag := make([]byte, 4)
+	_, err := r.ReadAt(tag, 1080)
+	if err != nil {
+		return false
+	}
+
+	switch string(tag) {
+	case "M.K.", "FLT4", "M!K!", "4CHN", "6CHN", "OCTA", "FLT8", "CD81", "8CHN":
+		return true
+	}
+
+	return false
+}
+
+func (modLoader) Load(r io.Reader) (*tracker.Modfile, error) {
+
+	var err error
+
+	modfile := new(tracker.Modfile)
+
+	// Make a note of the file's size, if we can (needed for the filesize sanity check below)...
+
+	if f, ok := r.(*os.File); ok {
+		stats, err := f.Stat()
+		if err != nil {
+			return modfile, err
+		}
+		modfile.Filesize = stats.Size()
+	}
+
+	// Search for a known format tag at location 1080 (decimal)...
+
+	if ra, ok := r.(io.ReaderAt); ok {
+		tag := make([]byte, 4)
+		_, err = ra.ReadAt(tag, 1080)
+		if err != nil {
+			return modfile, err
+		}
+		modfile.Format, modfile.ChannelCount, modfile.SampleCount = mod_format_from_tag(string(tag))
+	} else {
+		modfile.ChannelCount, modfile.SampleCount = 4, 16		// Assume an old-style 15-instrument MOD.
+	}
+
+	infile := bufio.NewReader(r)
+
+	// Load title...
+
+	modfile.Title, err = load_string(infile, 20)
+	if err != nil {
+		return modfile, err
+	}
+
+	// Load sample metadata...
+
+	modfile.Samples = make([]*tracker.Sample, modfile.SampleCount)
+	modfile.Samples[0] = nil		// No sample zero
+
+	for n := 1; n < modfile.SampleCount; n++ {
+		sample, err := load_mod_sample_info(infile)
+		if err != nil {
+			return modfile, err
+		}
+		modfile.Samples[n] = sample
+	}
+
+	// Load position count, which is how long the useful part of the table is (I think)...
+
+	positions, err := infile.ReadByte()
+	if err != nil {
+		return modfile, err
+	}
+
+	// Load an irrelevant byte that we "can safely ignore" allegedly...
+
+	_, err = infile.ReadByte()
+	if err != nil {
+		return modfile, err
+	}
+
+	// Load the table of patterns to play (always 128 long regardless of actual song length)...
+
+	modfile.Table = make([]int, positions)
+
+	highest_pattern := 0
+	table_values := make(map[byte]bool)
+
+	patterns_exceed_table_length := false
+
+	for n := 0; n < 128; n++ {
+		val, err := infile.ReadByte()
+		if err != nil {
+			return modfile, err
+		}
+		table_values[val] = true
+		if n < len(modfile.Table) {
+			modfile.Table[n] = int(val)
+			if int(val) > highest_pattern {
+				highest_pattern = int(val)
+			}
+		} else if val != 0 {
+			patterns_exceed_table_length = true
+		}
+	}
+
+	if patterns_exceed_table_length {
+		fmt.Printf("WARNING: patterns continue in the table past its expected length.\n")
+	}
+
+	if len(table_values) != highest_pattern + 1 {
+		fmt.Printf("WARNING: some pattern numbers are not in the table.\n")
+	}
+
+	// If the file was found to have a 4 byte format string, skip past it...
+
+	if modfile.Format != "" {
+		infile.ReadByte(); infile.ReadByte(); infile.ReadByte(); infile.ReadByte()
+	}
+
+	// Load the pattern data...
+
+	modfile.Patterns = make([]*tracker.Pattern, highest_pattern + 1)
+
+	for n := 0; n < len(modfile.Patterns); n++ {
+		modfile.Patterns[n] = new(tracker.Pattern)
+		modfile.Patterns[n].Lines = make([][]*tracker.Note, 64)		// Always 64 lines in a pattern
+		for i := 0; i < 64; i++ {
+			modfile.Patterns[n].Lines[i] = make([]*tracker.Note, modfile.ChannelCount)
+		}
+	}
+
+	for n := 0; n < len(modfile.Patterns); n++ {				// For each pattern...
+		for i := 0; i < 64; i++ {								// For each line...
+			for ch := 0; ch < modfile.ChannelCount; ch++ {		// For each channel...
+				modfile.Patterns[n].Lines[i][ch], err = load_mod_note(infile)
+			}
+		}
+	}
+
+	// With all metadata loaded, we can now calculate an expected filesize, if we know the real one...
+
+	if modfile.Filesize != 0 {
+
+		small_filesize, large_filesize := mod_expected_filesizes(modfile)
+
+		if small_filesize != modfile.Filesize && large_filesize != modfile.Filesize {
+			return modfile, fmt.Errorf("Filesize was %v, expected %v or %v", modfile.Filesize, small_filesize, large_filesize)
+		}
+
+		// Apply a correction for blank samples having length 1 (meaning 2 bytes)...
+
+		for n := 1; n < len(modfile.Samples); n++ {
+			if modfile.Samples[n].Length == 0 && modfile.Filesize == large_filesize {
+				modfile.Samples[n].Length = 1		// Gets doubled, below
+			}
+		}
+	}
+
+	// Load the samples...
+
+	for n := 1; n < len(modfile.Samples); n++ {
+
+		sample := modfile.Samples[n]
+
+		raw := make([]byte, sample.Length * 2)
+		_, err = io.ReadFull(infile, raw)
+		if err != nil {
+			return modfile, err
+		}
+
+		sample.Data = make([]int16, len(raw))
+		for i, b := range raw {
+			sample.Data[i] = mod_byte_to_int16(b)
+		}
+		sample.Length = len(sample.Data)
+	}
+
+	// Count any unread bytes (there must be a better way, but remember we are using buffered IO)...
+
+	for {
+		_, err := infile.ReadByte()
+		if err != nil {
+			break
+		}
+		modfile.Unread++
+	}
+
+	return modfile, nil
+}
+
+func mod_format_from_tag(tag string) (format string, channels int, instruments int) {
+
+	switch tag {
+
+	case "M.K.", "FLT4", "M!K!", "4CHN":
+		channels = 4
+		instruments = 32
+
+	case "6CHN":
+		channels = 6
+		instruments = 32
+
+	case "OCTA", "FLT8", "CD81", "8CHN":
+		channels = 8
+		instruments = 32
+
+	default:
+		channels = 4
+		instruments = 16
+		tag = ""
+	}
+
+	return tag, channels, instruments
+}
+
+func mod_expected_filesizes(modfile *tracker.Modfile) (int64, int64) {
+
+	// Only valid to call once most metadata has been loaded.
+	// Returns 2 values:
+	//    - one for a filesize where blank samples have size 0
+	//    - one for a filesize where blank samples have size 2
+
+	const (
+		TITLE = 20
+		SAMPLEMETA = 30
+		EXTRAMETA = 2
+		TABLE = 128
+		FORMAT = 4
+		LINES = 64
+		NOTE = 4
+	)
+
+	var blank_samples int64
+
+	for _, sample := range modfile.Samples[1:] {
+		if sample.Length == 0 {
+			blank_samples++
+		}
+	}
+
+	var naive int64
+
+	naive += TITLE
+	naive += (SAMPLEMETA * (int64(modfile.SampleCount) - 1))
+	naive += EXTRAMETA + TABLE + FORMAT
+	naive += int64(modfile.ChannelCount) * LINES * NOTE * int64(len(modfile.Patterns))
+	for _, sample := range modfile.Samples[1:] {
+		naive += int64(sample.Length) * 2
+	}
+
+	if modfile.Format == "" {		// The format string (probably) won't be present.
+		naive -= 4
+	}
+
+	return naive, naive + blank_samples * 2
+}
+
+func load_mod_sample_info(infile *bufio.Reader) (*tracker.Sample, error) {
+
+	var err error
+
+	sample := tracker.NewSample()
+	sample.BitsPerSample = 8
+
+	sample.Name, err = load_string(infile, 22)
+	if err != nil {
+		return nil, fmt.Errorf("load_mod_sample_info: %v", err)
+	}
+
+	sample.Length, err = load_big_endian_16(infile)
+	if err != nil {
+		return nil, fmt.Errorf("load_mod_sample_info: %v", err)
+	}
+
+	finetune, err := infile.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("load_mod_sample_info: %v", err)
+	}
+	sample.Finetune = int(finetune)
+	if sample.Finetune > 7 {			// It's a signed 4-bit value...
+		sample.Finetune -= 16			// Therefore 8 means -8, 9 means -7, etc (hope I have this right)
+	}
+
+	volume, err := infile.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("load_mod_sample_info: %v", err)
+	}
+	sample.Volume = int(volume)
+
+	sample.RepOffset, err = load_big_endian_16(infile)
+	if err != nil {
+		return nil, fmt.Errorf("load_mod_sample_info: %v", err)
+	}
+
+	sample.RepLength, err = load_big_endian_16(infile)
+	if err != nil {
+		return nil, fmt.Errorf("load_mod_sample_info: %v", err)
+	}
+
+	if sample.RepLength > 1 {
+		sample.LoopType = tracker.LoopForward
+	}
+
+	return sample, nil
+}
+
+func load_big_endian_16(infile *bufio.Reader) (int, error) {
+
+	var a, b byte
+	var err error
+
+	a, err = infile.ReadByte()
+	if err != nil {
+		return 0, fmt.Errorf("load_big_endian_16: %v", err)
+	}
+
+	b, err = infile.ReadByte()
+	if err != nil {
+		return 0, fmt.Errorf("load_big_endian_16: %v", err)
+	}
+
+	return (int(a) << 8) + int(b), nil
+}
+
+func load_string(infile *bufio.Reader, length int) (string, error) {
+	raw := make([]byte, length)
+	_, err := io.ReadFull(infile, raw)
+	if err != nil {
+		return "", fmt.Errorf("load_string: %v", err)
+	}
+	return strings.TrimRight(string(raw), "\x00"), nil
+}
+
+func load_mod_note(infile *bufio.Reader) (*tracker.Note, error) {
+	raw := make([]byte, 4)
+	_, err := io.ReadFull(infile, raw)
+	if err != nil {
+		return nil, fmt.Errorf("load_mod_note: %v", err)
+	}
+
+	note := new(tracker.Note)
+
+	note.Sample = int((raw[0] & 0xf0) | (raw[2] >> 4))		// Make a new byte out of left 4 bits of 1st byte and left 4 bits of 3rd byte
+	note.Period = 256 * int(raw[0] & 0x0f) + int(raw[1])	// A 12-bit value comprised of the right 4 bits of 1st byte and all the 2nd byte
+	note.Effect = int(raw[2] & 0x0f)						// Value in range 0-15, from the right 4 bits of 3rd byte
+	note.Parameter = int(raw[3])							// The 4th byte
+
+	return note, nil
+}
+
+// mod_byte_to_int16 widens an 8-bit signed sample byte to the full int16 range.
+
+func mod_byte_to_int16(val byte) int16 {		// Assuming the byte is supposed to be signed... so 127 --> +32767 but 128 --> -32768
+
+	val_as_int16 := int16(val)
+
+	// Since the byte is supposed to be a signed val, convert like so...
+
+	if val_as_int16 > 127 {
+		val_as_int16 -= 256
+	}
+
+	return int16(val_as_int16) * 256 + int16(val_as_int16) + 128
+}
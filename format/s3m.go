@@ -0,0 +1,306 @@
+package format
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/fohristiwhirl/mod_to_wav/tracker"
+)
+
+// s3mLoader loads Scream Tracker 3 modules, identified by the "SCRM" tag at offset 44.
+
+type s3mLoader struct{}
+
+func (s3mLoader) Detect(r io.ReaderAt) bool {
+	tag := make([]byte, 4)
+	_, err := r.ReadAt(tag, 44)
+	if err != nil {
+		return false
+	}
+	return string(tag) == "SCRM"
+}
+
+// S3M effects are stored as a command number, 1 meaning 'A', 2 meaning 'B', and so on. Most of
+// these map directly onto the same effect space the MOD engine already understands (0x0-0xF plus
+// the Exy extended sub-commands), so notes can be played back by the existing Mixer unchanged.
+// Effects with no close MOD equivalent (e.g. Ixx tremor, Qxy retrigger+volslide) are dropped.
+
+var s3m_effect_map = map[int]int{
+	1:  tracker.SET_SPEED,
+	2:  tracker.POSITION_JUMP,
+	3:  tracker.PATTERN_BREAK,
+	4:  tracker.VOLUME_SLIDE,
+	5:  tracker.PORTA_DOWN,
+	6:  tracker.PORTA_UP,
+	7:  tracker.TONE_PORTA,
+	8:  tracker.VIBRATO,
+	10: tracker.ARPEGGIO,
+	11: tracker.VIBRATO_VOLSLIDE,
+	12: tracker.TONE_PORTA_VOLSLIDE,
+	15: tracker.SAMPLE_OFFSET,
+	18: tracker.TREMOLO,
+	20: tracker.SET_SPEED,		// Txx sets tempo (BPM); reuses the same "set speed" slot as Axx
+}
+
+func (s3mLoader) Load(r io.Reader) (*tracker.Modfile, error) {
+
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("s3mLoader.Load: %v", err)
+	}
+
+	if len(raw) < 96 {
+		return nil, fmt.Errorf("s3mLoader.Load: file too short to be an S3M")
+	}
+
+	modfile := new(tracker.Modfile)
+	modfile.Filesize = int64(len(raw))
+	modfile.Format = "S3M"
+
+	modfile.Title = strings.TrimRight(string(raw[0:28]), "\x00")
+
+	order_count := int(raw[32]) + int(raw[33]) << 8
+	instrument_count := int(raw[34]) + int(raw[35]) << 8
+	pattern_count := int(raw[36]) + int(raw[37]) << 8
+	default_pan_flag := raw[53]
+
+	// Count actually-used channels from the channel settings table (channel disabled == 0xff)...
+
+	channel_count := 0
+	for ch := 0; ch < 32; ch++ {
+		if raw[64+ch] != 0xff {
+			channel_count = ch + 1
+		}
+	}
+	if channel_count == 0 {
+		channel_count = 4
+	}
+	modfile.ChannelCount = channel_count
+	modfile.SampleCount = instrument_count + 1		// Keep the same "sample 0 is unused" convention as MOD.
+
+	pos := 96
+
+	// Order list: 254 marks a skipped pattern slot, 255 marks the end of the song. Both are
+	// dropped rather than kept as real Table entries, since the tracker.Modfile.Table is just a
+	// flat list of playable pattern indices.
+
+	modfile.Table = nil
+	for n := 0; n < order_count && pos < len(raw); n++ {
+		order := int(raw[pos])
+		pos++
+		if order != 254 && order != 255 {
+			modfile.Table = append(modfile.Table, order)
+		}
+	}
+
+	instrument_pointers := make([]int, instrument_count)
+	for n := 0; n < instrument_count; n++ {
+		if pos + 1 >= len(raw) {
+			break
+		}
+		instrument_pointers[n] = (int(raw[pos]) + int(raw[pos + 1]) << 8) * 16
+		pos += 2
+	}
+
+	pattern_pointers := make([]int, pattern_count)
+	for n := 0; n < pattern_count; n++ {
+		if pos + 1 >= len(raw) {
+			break
+		}
+		pattern_pointers[n] = (int(raw[pos]) + int(raw[pos + 1]) << 8) * 16
+		pos += 2
+	}
+
+	if default_pan_flag == 0xfc {
+		pos += 32		// Per-channel default pan bytes; playback uses the fixed Amiga LRRL pan, so skip them.
+	}
+
+	// Load instruments (samples)...
+
+	modfile.Samples = make([]*tracker.Sample, modfile.SampleCount)
+
+	for n := 0; n < instrument_count; n++ {
+
+		ptr := instrument_pointers[n]
+
+		sample, err := load_s3m_sample(raw, ptr)
+		if err != nil {
+			return modfile, fmt.Errorf("s3mLoader.Load: instrument %v: %v", n + 1, err)
+		}
+
+		modfile.Samples[n + 1] = sample
+	}
+
+	// Load patterns...
+
+	modfile.Patterns = make([]*tracker.Pattern, pattern_count)
+
+	for n := 0; n < pattern_count; n++ {
+		pattern, err := load_s3m_pattern(raw, pattern_pointers[n], channel_count)
+		if err != nil {
+			return modfile, fmt.Errorf("s3mLoader.Load: pattern %v: %v", n, err)
+		}
+		modfile.Patterns[n] = pattern
+	}
+
+	return modfile, nil
+}
+
+func load_s3m_sample(raw []byte, ptr int) (*tracker.Sample, error) {
+
+	if ptr == 0 || ptr + 80 > len(raw) {
+		return tracker.NewSample(), nil		// Empty instrument slot.
+	}
+
+	sample_type := raw[ptr]
+	if sample_type != 1 {
+		return tracker.NewSample(), nil		// Not a PCM sample (e.g. an Adlib instrument); leave it silent.
+	}
+
+	sample := tracker.NewSample()
+
+	data_ptr := ((int(raw[ptr + 13]) << 16) + int(raw[ptr + 14]) + int(raw[ptr + 15]) << 8) * 16
+
+	length := int(raw[ptr + 16]) + int(raw[ptr + 17]) << 8 + int(raw[ptr + 18]) << 16 + int(raw[ptr + 19]) << 24
+	rep_offset := int(raw[ptr + 20]) + int(raw[ptr + 21]) << 8 + int(raw[ptr + 22]) << 16 + int(raw[ptr + 23]) << 24
+	rep_end := int(raw[ptr + 24]) + int(raw[ptr + 25]) << 8 + int(raw[ptr + 26]) << 16 + int(raw[ptr + 27]) << 24
+
+	sample.Volume = int(raw[ptr + 28])
+
+	flags := raw[ptr + 31]
+	is_16_bit := flags & 0x04 != 0
+	is_looped := flags & 0x01 != 0
+
+	c2spd := int(raw[ptr + 32]) + int(raw[ptr + 33]) << 8 + int(raw[ptr + 34]) << 16 + int(raw[ptr + 35]) << 24
+
+	sample.Name = strings.TrimRight(string(raw[ptr + 48 : ptr + 48 + 28]), "\x00")
+
+	if is_16_bit {
+		sample.BitsPerSample = 16
+	} else {
+		sample.BitsPerSample = 8
+	}
+
+	if is_looped {
+		sample.LoopType = tracker.LoopForward
+		sample.RepOffset = rep_offset
+		sample.RepLength = rep_end - rep_offset
+	}
+
+	// Period-based pitch (as used by Channel/Mixer playback) assumes the Amiga's implicit 8363Hz
+	// middle-C rate; S3M instead gives an explicit C2SPD, so fold the difference into PeriodScale
+	// (the same mechanism the SF2 loader uses) rather than snapping onto one of the 16 Amiga
+	// finetune values, which can't represent anything outside of about a semitone of 8363Hz.
+
+	if c2spd == 0 {
+		c2spd = 8363
+	}
+	sample.PeriodScale = 8363.0 / float64(c2spd)
+
+	byte_length := length
+	if is_16_bit {
+		byte_length = length * 2
+	}
+
+	if data_ptr == 0 || data_ptr + byte_length > len(raw) {
+		return sample, nil
+	}
+
+	sample.Data = make([]int16, length)
+
+	if is_16_bit {
+		for i := 0; i < length; i++ {
+			lo := raw[data_ptr + i * 2]
+			hi := raw[data_ptr + i * 2 + 1]
+			sample.Data[i] = int16((uint16(lo) | uint16(hi) << 8) - 0x8000)		// S3M 16-bit samples are unsigned too.
+		}
+	} else {
+		for i := 0; i < length; i++ {
+			sample.Data[i] = mod_byte_to_int16(raw[data_ptr + i] - 128)		// S3M 8-bit samples are unsigned.
+		}
+	}
+
+	sample.Length = len(sample.Data)
+
+	return sample, nil
+}
+
+func load_s3m_pattern(raw []byte, ptr int, channel_count int) (*tracker.Pattern, error) {
+
+	pattern := new(tracker.Pattern)
+	pattern.Lines = make([][]*tracker.Note, 64)
+	for i := range pattern.Lines {
+		pattern.Lines[i] = make([]*tracker.Note, channel_count)
+		for ch := range pattern.Lines[i] {
+			pattern.Lines[i][ch] = new(tracker.Note)
+		}
+	}
+
+	if ptr == 0 || ptr + 2 > len(raw) {
+		return pattern, nil		// Empty pattern slot.
+	}
+
+	packed_length := int(raw[ptr]) + int(raw[ptr + 1]) << 8
+	end := ptr + 2 + packed_length
+	if end > len(raw) {
+		end = len(raw)
+	}
+	body := raw[ptr + 2 : end]
+
+	reader := bufio.NewReader(bytes.NewReader(body))
+
+	for row := 0; row < 64; row++ {
+		for {
+			flag, err := reader.ReadByte()
+			if err != nil {
+				return pattern, nil
+			}
+			if flag == 0 {
+				break
+			}
+
+			channel := int(flag & 0x1f)
+
+			var note *tracker.Note
+			if channel < channel_count {
+				note = pattern.Lines[row][channel]
+			} else {
+				note = new(tracker.Note)		// Discard data for channels beyond what we support.
+			}
+
+			if flag & 0x20 != 0 {
+				note_byte, _ := reader.ReadByte()
+				inst_byte, _ := reader.ReadByte()
+				if note_byte != 255 && note_byte != 254 {
+					octave := int(note_byte >> 4)
+					semitone := int(note_byte & 0x0f)
+					semitone_index := clamp_int(octave * 12 + semitone - 36, 0, 35)	// Anchor S3M's octave 3 onto the period table's first row, as the XM loader does.
+					note.Period = tracker.PeriodForFinetune(0, semitone_index)
+				}
+				note.Sample = int(inst_byte)
+			}
+
+			if flag & 0x40 != 0 {
+				vol_byte, _ := reader.ReadByte()
+				if note.Effect == 0 && vol_byte <= 64 {
+					note.Effect = tracker.SET_VOLUME
+					note.Parameter = int(vol_byte)
+				}
+			}
+
+			if flag & 0x80 != 0 {
+				effect_byte, _ := reader.ReadByte()
+				param_byte, _ := reader.ReadByte()
+				if mapped, ok := s3m_effect_map[int(effect_byte)]; ok {
+					note.Effect = mapped
+					note.Parameter = int(param_byte)
+				}
+			}
+		}
+	}
+
+	return pattern, nil
+}
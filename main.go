@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/fohristiwhirl/mod_to_wav/format"
+	"github.com/fohristiwhirl/mod_to_wav/player"
+	"github.com/fohristiwhirl/mod_to_wav/tracker"
+)
+
+func main() {
+
+	sf2Path := flag.String("sf2", "", "SF2 SoundFont file to source sample playback from, instead of the module's own samples")
+	sf2Map := flag.String("map", "", `sample mapping for -sf2, e.g. "1:0/24,2:0/38" (modSample:bank/preset)`)
+	split := flag.String("split", "", `split the output into stems instead of one combined WAV: "channel" or "sample"`)
+	rate := flag.Int("rate", 44100, "output sample rate in Hz")
+	bits := flag.Int("bits", 16, "output bits per sample: 8, 16, 24, or 32 (32 = IEEE float)")
+	channels := flag.Int("channels", 2, "output channel count: 1 (mono downmix) or 2 (stereo)")
+	play := flag.Bool("play", false, "play the module in real time through PortAudio instead of writing a WAV")
+
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		return
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+
+	modfile, err := format.LoadFile(f)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+
+	if *sf2Path != "" {
+		err = apply_soundfont(modfile, *sf2Path, *sf2Map)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			return
+		}
+	}
+
+	if *channels != 1 && *channels != 2 {
+		fmt.Printf("-channels must be 1 or 2\n")
+		return
+	}
+
+	modfile.PrintAll()
+
+	if *play {
+		p, err := player.Play(modfile)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			return
+		}
+		p.Wait()
+		p.Stop()
+		return
+	}
+
+	if *split == "" {
+		wav := tracker.GenerateWav(modfile)
+		err = save_wav(wav, fmt.Sprintf("%s.wav", flag.Arg(0)), *rate, *bits, *channels)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+		}
+		return
+	}
+
+	mode, err := split_mode_from_flag(*split)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+
+	wavs, err := tracker.Render(modfile, tracker.RenderOptions{Mode: mode})
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+
+	for key, wav := range wavs {
+		path := fmt.Sprintf("%s.%s.wav", flag.Arg(0), key)
+		if key == "combined" {
+			path = fmt.Sprintf("%s.wav", flag.Arg(0))
+		}
+		err = save_wav(wav, path, *rate, *bits, *channels)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			return
+		}
+	}
+}
+
+func split_mode_from_flag(split string) (tracker.RenderMode, error) {
+	switch split {
+	case "channel":
+		return tracker.PerChannel, nil
+	case "sample":
+		return tracker.PerSample, nil
+	default:
+		return tracker.Combined, fmt.Errorf(`unknown -split mode %q (want "channel" or "sample")`, split)
+	}
+}
@@ -0,0 +1,180 @@
+// Package player provides real-time playback of a tracker.Modfile through PortAudio, by driving
+// a tracker.Mixer one tick at a time from a background goroutine and feeding the resulting frames
+// to the audio callback through a ring buffer.
+package player
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gordonklaus/portaudio"
+
+	"github.com/fohristiwhirl/mod_to_wav/tracker"
+)
+
+const (
+	SampleRate   = 44100
+	Channels     = 2
+	ringCapacity = SampleRate * Channels * 2		// 2 seconds of headroom
+)
+
+// Player drives a tracker.Modfile's Mixer in real time through a PortAudio output stream.
+
+type Player struct {
+	modfile *tracker.Modfile
+	mixer   *tracker.Mixer
+	stream  *portaudio.Stream
+
+	lock    sync.Mutex
+	ring    []int16
+	ringLen int
+	paused  bool
+	stopped bool
+
+	done chan struct{}		// Closed once fill_loop exits, whether the song ended or Stop was called.
+}
+
+// Play opens the default PortAudio output device and starts playing modfile from the beginning.
+// Call Stop when done with the Player to release the stream.
+
+func Play(modfile *tracker.Modfile) (*Player, error) {
+
+	err := portaudio.Initialize()
+	if err != nil {
+		return nil, fmt.Errorf("Play: %v", err)
+	}
+
+	self := &Player{
+		modfile: modfile,
+		mixer:   tracker.NewMixer(modfile),
+		ring:    make([]int16, ringCapacity),
+		done:    make(chan struct{}),
+	}
+
+	stream, err := portaudio.OpenDefaultStream(0, Channels, float64(SampleRate), 0, self.callback)
+	if err != nil {
+		portaudio.Terminate()
+		return nil, fmt.Errorf("Play: %v", err)
+	}
+	self.stream = stream
+
+	err = stream.Start()
+	if err != nil {
+		stream.Close()
+		portaudio.Terminate()
+		return nil, fmt.Errorf("Play: %v", err)
+	}
+
+	go self.fill_loop()
+
+	return self, nil
+}
+
+// fill_loop runs in the background, stepping the mixer and appending its frames to the ring
+// buffer whenever there's room, until the song ends or the Player is stopped.
+
+func (self *Player) fill_loop() {
+
+	defer close(self.done)
+
+	for {
+
+		self.lock.Lock()
+		stopped := self.stopped
+		paused := self.paused
+		room := len(self.ring) - self.ringLen
+		self.lock.Unlock()
+
+		if stopped {
+			return
+		}
+
+		if paused || room < SampleRate/10*Channels {
+			time.Sleep(5 * time.Millisecond)		// Nothing to do yet; don't spin the CPU.
+			continue
+		}
+
+		frames, done := self.mixer.Step()
+
+		self.lock.Lock()
+		self.ring = append(self.ring[:self.ringLen], frames...)
+		self.ringLen += len(frames)
+		self.lock.Unlock()
+
+		if done {
+			return
+		}
+	}
+}
+
+// callback is the PortAudio stream callback. It drains as many frames as are available from the
+// ring buffer into out, padding with silence if the mixer hasn't kept up (or the song has ended).
+
+func (self *Player) callback(out []int16) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	n := copy(out, self.ring[:self.ringLen])
+	copy(self.ring, self.ring[n:self.ringLen])
+	self.ringLen -= n
+
+	for i := n; i < len(out); i++ {
+		out[i] = 0
+	}
+}
+
+// Pause suspends mixing; the stream keeps running but plays silence once the ring buffer drains.
+
+func (self *Player) Pause() {
+	self.lock.Lock()
+	self.paused = true
+	self.lock.Unlock()
+}
+
+// Resume undoes a prior Pause.
+
+func (self *Player) Resume() {
+	self.lock.Lock()
+	self.paused = false
+	self.lock.Unlock()
+}
+
+// Seek jumps playback to the given order and row, discarding any buffered audio.
+
+func (self *Player) Seek(order int, row int) {
+	self.lock.Lock()
+	self.mixer.Seek(order, row)
+	self.ringLen = 0
+	self.lock.Unlock()
+}
+
+// Position returns the order and row the mixer is currently rendering.
+
+func (self *Player) Position() (order int, row int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.mixer.Position()
+}
+
+// Wait blocks until the song has played to its end, or the Player is stopped.
+
+func (self *Player) Wait() {
+	<-self.done
+}
+
+// Stop halts playback and releases the PortAudio stream. The Player must not be used afterwards.
+
+func (self *Player) Stop() error {
+
+	self.lock.Lock()
+	self.stopped = true
+	self.lock.Unlock()
+
+	err := self.stream.Stop()
+	self.stream.Close()
+	portaudio.Terminate()
+
+	return err
+}
@@ -0,0 +1,588 @@
+// Package soundfont parses SF2 SoundFont files -- the RIFF-based instrument bank format used by
+// MIDI synthesizers -- and resolves a preset down to the playable zones a caller needs in order
+// to substitute real instrument recordings for a tracker module's own samples. It understands the
+// INFO, sdta (raw 16-bit PCM pool) and pdta (PHDR/PBAG/PMOD/PGEN/INST/IBAG/IMOD/IGEN/SHDR) chunks;
+// modulators (PMOD/IMOD) are read only to skip over them, since nothing here drives them yet.
+package soundfont
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Zone is one playable leaf of a resolved preset: a single sample plus everything needed to pitch
+// and loop it correctly (root key, fine tune, loop points) and the key/velocity range it responds
+// to. It is the result of combining a preset zone's generators with its instrument zone's
+// generators, per the SF2 spec's two-level (relative over absolute) generator model.
+
+type Zone struct {
+	SampleID	int				// Index into the soundfont's sample pool (also the key LoadSamplesForPreset returns under).
+	SampleName	string
+
+	KeyLo, KeyHi	int			// MIDI note range (0-127) this zone responds to.
+	VelLo, VelHi	int			// MIDI velocity range (0-127) this zone responds to.
+
+	RootKey			int			// MIDI note at which the sample plays at its recorded pitch.
+	FineTune		int			// Cents, combining SHDR pitch correction plus the coarse/fine tune generators.
+	Attenuation		int			// Centibels of volume reduction from full scale.
+	Pan				int			// -500..+500 (tenths of a percent), 0 being centre.
+
+	SampleStart, SampleEnd	uint32	// Absolute frame indices into the sample pool, after any addrsOffset generators.
+	LoopStart, LoopEnd		uint32	// Absolute frame indices into the sample pool, after any loop addrsOffset generators.
+	SampleRate				uint32
+	LoopForever				bool	// True unless sampleModes said "no loop".
+
+	// Raw SF2 volume envelope generators (timecents for the time-based ones, centibels for
+	// SustainVolEnv), exposed for callers that want to shape amplitude themselves; nothing in
+	// this package or in mod_to_wav's Mixer applies them.
+	DelayVolEnv, AttackVolEnv, HoldVolEnv, DecayVolEnv, SustainVolEnv, ReleaseVolEnv int
+}
+
+// Preset is one SF2 preset (an General MIDI "instrument" in the bank/program sense) resolved to
+// its full list of playable Zones.
+
+type Preset struct {
+	Name		string
+	Bank		int
+	ProgramNum	int
+	Zones		[]Zone
+}
+
+// SoundFont holds a parsed SF2 file's presets, plus enough of the raw pdta records and sample
+// pool bytes to let LoadSamplesForPreset pull out PCM on demand.
+
+type SoundFont struct {
+	Presets []Preset
+
+	presetHeaders	[]presetHeaderRecord
+	pbag			[]bagRecord
+	pgen			[]genRecord
+	instruments		[]instRecord
+	ibag			[]bagRecord
+	igen			[]genRecord
+	sampleHeaders	[]sampleHeaderRecord
+
+	sampleDataBytes []byte		// The sdta LIST's "smpl" sub-chunk: one int16 (little-endian) per frame, mono.
+}
+
+// --------------------------------------------------------------------------------------------------
+
+type presetHeaderRecord struct {
+	name		string
+	preset		int
+	bank		int
+	bagIndex	int
+}
+
+type bagRecord struct {
+	genNdx int
+	modNdx int
+}
+
+type genRecord struct {
+	oper   uint16
+	amount int16
+}
+
+type instRecord struct {
+	name		string
+	bagIndex	int
+}
+
+type sampleHeaderRecord struct {
+	name			string
+	start, end		uint32
+	startLoop		uint32
+	endLoop			uint32
+	sampleRate		uint32
+	originalPitch	byte
+	pitchCorrection	int8
+}
+
+// genMap holds one zone's resolved generators, keyed by SF2 generator operator number.
+
+type genMap map[uint16]int16
+
+// The SF2 generator operators this package understands; everything else is read but ignored.
+
+const (
+	genStartAddrsOffset			= 0
+	genEndAddrsOffset				= 1
+	genStartloopAddrsOffset		= 2
+	genEndloopAddrsOffset			= 3
+	genStartAddrsCoarseOffset		= 4
+	genEndAddrsCoarseOffset			= 12
+	genPan							= 17
+	genDelayVolEnv					= 33
+	genAttackVolEnv					= 34
+	genHoldVolEnv					= 35
+	genDecayVolEnv					= 36
+	genSustainVolEnv				= 37
+	genReleaseVolEnv				= 38
+	genInstrument					= 41
+	genKeyRange						= 43
+	genVelRange						= 44
+	genStartloopAddrsCoarseOffset	= 45
+	genInitialAttenuation			= 48
+	genEndloopAddrsCoarseOffset		= 50
+	genCoarseTune					= 51
+	genFineTune						= 52
+	genSampleID						= 53
+	genSampleModes					= 54
+	genOverridingRootKey			= 58
+)
+
+// --------------------------------------------------------------------------------------------------
+
+// Load reads an entire SF2 file and parses it into a SoundFont. Sample PCM itself is not decoded
+// here -- only the pdta metadata and the raw sdta bytes are kept -- see LoadSamplesForPreset.
+
+func Load(r io.Reader) (*SoundFont, error) {
+
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("soundfont.Load: %v", err)
+	}
+
+	if len(raw) < 12 || string(raw[0:4]) != "RIFF" || string(raw[8:12]) != "sfbk" {
+		return nil, fmt.Errorf("soundfont.Load: not an SF2 file (missing RIFF/sfbk header)")
+	}
+
+	sf := new(SoundFont)
+
+	var phdrRaw, pbagRaw, pgenRaw, instRaw, ibagRaw, igenRaw, shdrRaw []byte
+
+	walk_chunks(raw[12:], func(id string, body []byte) {
+
+		if id != "LIST" || len(body) < 4 {
+			return
+		}
+
+		switch string(body[0:4]) {
+
+		case "sdta":
+			walk_chunks(body[4:], func(id string, body []byte) {
+				if id == "smpl" {
+					sf.sampleDataBytes = body
+				}
+			})
+
+		case "pdta":
+			walk_chunks(body[4:], func(id string, body []byte) {
+				switch id {
+				case "phdr": phdrRaw = body
+				case "pbag": pbagRaw = body
+				case "pgen": pgenRaw = body
+				case "inst": instRaw = body
+				case "ibag": ibagRaw = body
+				case "igen": igenRaw = body
+				case "shdr": shdrRaw = body
+				}
+			})
+		}
+	})
+
+	if phdrRaw == nil || pbagRaw == nil || pgenRaw == nil || instRaw == nil || ibagRaw == nil || igenRaw == nil || shdrRaw == nil {
+		return nil, fmt.Errorf("soundfont.Load: missing a required pdta sub-chunk")
+	}
+
+	sf.presetHeaders = parse_phdr(phdrRaw)
+	sf.pbag = parse_bag(pbagRaw)
+	sf.pgen = parse_gen(pgenRaw)
+	sf.instruments = parse_inst(instRaw)
+	sf.ibag = parse_bag(ibagRaw)
+	sf.igen = parse_gen(igenRaw)
+	sf.sampleHeaders = parse_shdr(shdrRaw)
+
+	// The final PHDR record is a terminal sentinel carrying no preset of its own, just the bag
+	// index that bounds the real last preset's zones.
+
+	for p := 0; p < len(sf.presetHeaders)-1; p++ {
+		sf.Presets = append(sf.Presets, Preset{
+			Name:       sf.presetHeaders[p].name,
+			Bank:       sf.presetHeaders[p].bank,
+			ProgramNum: sf.presetHeaders[p].preset,
+			Zones:      sf.resolve_preset(p),
+		})
+	}
+
+	return sf, nil
+}
+
+// FindPreset looks up a preset by its General MIDI bank and program number, returning the index
+// to pass to LoadSamplesForPreset (and to index into SoundFont.Presets).
+
+func (sf *SoundFont) FindPreset(bank, program int) (int, bool) {
+	for i, p := range sf.Presets {
+		if p.Bank == bank && p.ProgramNum == program {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// LoadSamplesForPreset eagerly decodes just the PCM ranges that preset's zones actually reference
+// (not the whole soundfont's sample pool), returning them keyed by Zone.SampleID.
+
+func (sf *SoundFont) LoadSamplesForPreset(preset int) (map[int][]int16, error) {
+
+	if preset < 0 || preset >= len(sf.Presets) {
+		return nil, fmt.Errorf("LoadSamplesForPreset: preset index %d out of range", preset)
+	}
+
+	out := make(map[int][]int16)
+
+	for _, zone := range sf.Presets[preset].Zones {
+
+		if _, done := out[zone.SampleID]; done {
+			continue
+		}
+
+		pcm, err := sf.decode_sample(zone.SampleStart, zone.SampleEnd)
+		if err != nil {
+			return nil, fmt.Errorf("LoadSamplesForPreset: sample %q: %v", zone.SampleName, err)
+		}
+
+		out[zone.SampleID] = pcm
+	}
+
+	return out, nil
+}
+
+func (sf *SoundFont) decode_sample(start, end uint32) ([]int16, error) {
+
+	byte_start := int(start) * 2
+	byte_end := int(end) * 2
+
+	if byte_start < 0 || byte_start > byte_end || byte_end > len(sf.sampleDataBytes) {
+		return nil, fmt.Errorf("PCM range [%d:%d) out of bounds", start, end)
+	}
+
+	raw := sf.sampleDataBytes[byte_start:byte_end]
+	pcm := make([]int16, len(raw)/2)
+
+	for i := range pcm {
+		pcm[i] = int16(binary.LittleEndian.Uint16(raw[i*2:]))
+	}
+
+	return pcm, nil
+}
+
+// --------------------------------------------------------------------------------------------------
+
+// walk_chunks iterates the RIFF chunks in data, calling fn with each one's 4 byte ID and body.
+// Chunks are word-aligned, so a chunk with an odd size is followed by one byte of padding.
+
+func walk_chunks(data []byte, fn func(id string, body []byte)) {
+
+	pos := 0
+
+	for pos+8 <= len(data) {
+
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+
+		body_start := pos + 8
+		body_end := body_start + size
+		if body_end > len(data) {
+			body_end = len(data)
+		}
+
+		fn(id, data[body_start:body_end])
+
+		pos = body_end
+		if size%2 == 1 {
+			pos++
+		}
+	}
+}
+
+func trim_name(b []byte) string {
+	return strings.TrimRight(string(b), "\x00")
+}
+
+func parse_phdr(body []byte) []presetHeaderRecord {
+
+	const recSize = 38
+	out := make([]presetHeaderRecord, len(body)/recSize)
+
+	for i := range out {
+		rec := body[i*recSize:]
+		out[i] = presetHeaderRecord{
+			name:     trim_name(rec[0:20]),
+			preset:   int(binary.LittleEndian.Uint16(rec[20:22])),
+			bank:     int(binary.LittleEndian.Uint16(rec[22:24])),
+			bagIndex: int(binary.LittleEndian.Uint16(rec[24:26])),
+		}
+	}
+
+	return out
+}
+
+func parse_bag(body []byte) []bagRecord {
+
+	const recSize = 4
+	out := make([]bagRecord, len(body)/recSize)
+
+	for i := range out {
+		rec := body[i*recSize:]
+		out[i] = bagRecord{
+			genNdx: int(binary.LittleEndian.Uint16(rec[0:2])),
+			modNdx: int(binary.LittleEndian.Uint16(rec[2:4])),
+		}
+	}
+
+	return out
+}
+
+func parse_gen(body []byte) []genRecord {
+
+	const recSize = 4
+	out := make([]genRecord, len(body)/recSize)
+
+	for i := range out {
+		rec := body[i*recSize:]
+		out[i] = genRecord{
+			oper:   binary.LittleEndian.Uint16(rec[0:2]),
+			amount: int16(binary.LittleEndian.Uint16(rec[2:4])),
+		}
+	}
+
+	return out
+}
+
+func parse_inst(body []byte) []instRecord {
+
+	const recSize = 22
+	out := make([]instRecord, len(body)/recSize)
+
+	for i := range out {
+		rec := body[i*recSize:]
+		out[i] = instRecord{
+			name:     trim_name(rec[0:20]),
+			bagIndex: int(binary.LittleEndian.Uint16(rec[20:22])),
+		}
+	}
+
+	return out
+}
+
+func parse_shdr(body []byte) []sampleHeaderRecord {
+
+	const recSize = 46
+	out := make([]sampleHeaderRecord, len(body)/recSize)
+
+	for i := range out {
+		rec := body[i*recSize:]
+		out[i] = sampleHeaderRecord{
+			name:            trim_name(rec[0:20]),
+			start:           binary.LittleEndian.Uint32(rec[20:24]),
+			end:             binary.LittleEndian.Uint32(rec[24:28]),
+			startLoop:       binary.LittleEndian.Uint32(rec[28:32]),
+			endLoop:         binary.LittleEndian.Uint32(rec[32:36]),
+			sampleRate:      binary.LittleEndian.Uint32(rec[36:40]),
+			originalPitch:   rec[40],
+			pitchCorrection: int8(rec[41]),
+		}
+	}
+
+	return out
+}
+
+// --------------------------------------------------------------------------------------------------
+
+// resolve_preset walks preset p's PBAG zones, merging each one's PGEN generators over whichever
+// zone (conventionally the first) turns out to be the global zone -- identified, per the SF2
+// spec, as the one zone in the range with no terminal "instrument" generator.
+
+func (sf *SoundFont) resolve_preset(p int) []Zone {
+
+	bagLo := sf.presetHeaders[p].bagIndex
+	bagHi := sf.presetHeaders[p+1].bagIndex
+
+	var globalPreset genMap
+	var zones []Zone
+
+	for b := bagLo; b < bagHi; b++ {
+
+		gens := sf.zone_generators(sf.pbag, sf.pgen, b)
+
+		if _, ok := gens[genInstrument]; !ok {
+			globalPreset = gens
+			continue
+		}
+
+		zones = append(zones, sf.resolve_instrument_zones(gens, globalPreset)...)
+	}
+
+	return zones
+}
+
+// resolve_instrument_zones resolves the instrument a preset zone points to, in exactly the same
+// global/local fashion as resolve_preset, then combines each resulting sample zone's (absolute)
+// generators with the preset zone's (relative) ones into a final playable Zone.
+
+func (sf *SoundFont) resolve_instrument_zones(presetZone genMap, globalPreset genMap) []Zone {
+
+	merged := merge_gen_maps(globalPreset, presetZone)
+
+	instIdx := int(merged[genInstrument])
+	if instIdx < 0 || instIdx+1 >= len(sf.instruments) {
+		return nil
+	}
+
+	bagLo := sf.instruments[instIdx].bagIndex
+	bagHi := sf.instruments[instIdx+1].bagIndex
+
+	var globalInst genMap
+	var zones []Zone
+
+	for b := bagLo; b < bagHi; b++ {
+
+		gens := sf.zone_generators(sf.ibag, sf.igen, b)
+
+		if _, ok := gens[genSampleID]; !ok {
+			globalInst = gens
+			continue
+		}
+
+		zones = append(zones, sf.build_zone(merge_gen_maps(globalInst, gens), merged))
+	}
+
+	return zones
+}
+
+func (sf *SoundFont) zone_generators(bags []bagRecord, gens []genRecord, bagIndex int) genMap {
+
+	if bagIndex+1 >= len(bags) {
+		return genMap{}
+	}
+
+	lo := bags[bagIndex].genNdx
+	hi := bags[bagIndex+1].genNdx
+
+	if hi > len(gens) {
+		hi = len(gens)
+	}
+
+	m := make(genMap, hi-lo)
+	for i := lo; i < hi; i++ {
+		m[gens[i].oper] = gens[i].amount
+	}
+
+	return m
+}
+
+func merge_gen_maps(global, zone genMap) genMap {
+
+	merged := make(genMap, len(global)+len(zone))
+
+	for k, v := range global {
+		merged[k] = v
+	}
+	for k, v := range zone {
+		merged[k] = v
+	}
+
+	return merged
+}
+
+// build_zone combines a resolved instrument zone's generators (absolute values) with its owning
+// preset zone's generators (relative modifiers, per the SF2 spec) into one playable Zone.
+
+func (sf *SoundFont) build_zone(instGens, presetGens genMap) Zone {
+
+	sampleID := int(instGens[genSampleID])
+
+	var shdr sampleHeaderRecord
+	if sampleID >= 0 && sampleID < len(sf.sampleHeaders) {
+		shdr = sf.sampleHeaders[sampleID]
+	}
+
+	keyLo, keyHi := range_gen_or_default(instGens, genKeyRange, 0, 127)
+	velLo, velHi := range_gen_or_default(instGens, genVelRange, 0, 127)
+
+	if lo, hi, ok := range_gen(presetGens, genKeyRange); ok {
+		keyLo, keyHi = intersect_range(keyLo, keyHi, lo, hi)
+	}
+	if lo, hi, ok := range_gen(presetGens, genVelRange); ok {
+		velLo, velHi = intersect_range(velLo, velHi, lo, hi)
+	}
+
+	rootKey := int(shdr.originalPitch)
+	if v, ok := instGens[genOverridingRootKey]; ok && v >= 0 {
+		rootKey = int(v)
+	}
+
+	fineTune := int(shdr.pitchCorrection)
+	fineTune += int(instGens[genFineTune]) + int(presetGens[genFineTune])
+	fineTune += 100 * (int(instGens[genCoarseTune]) + int(presetGens[genCoarseTune]))
+
+	sampleModes := int(instGens[genSampleModes])
+
+	return Zone{
+		SampleID:   sampleID,
+		SampleName: shdr.name,
+
+		KeyLo: keyLo, KeyHi: keyHi,
+		VelLo: velLo, VelHi: velHi,
+
+		RootKey:     rootKey,
+		FineTune:    fineTune,
+		Attenuation: int(instGens[genInitialAttenuation]) + int(presetGens[genInitialAttenuation]),
+		Pan:         int(instGens[genPan]) + int(presetGens[genPan]),
+
+		SampleStart: shdr.start + addr_offset(instGens, genStartAddrsOffset, genStartAddrsCoarseOffset),
+		SampleEnd:   shdr.end + addr_offset(instGens, genEndAddrsOffset, genEndAddrsCoarseOffset),
+		LoopStart:   shdr.startLoop + addr_offset(instGens, genStartloopAddrsOffset, genStartloopAddrsCoarseOffset),
+		LoopEnd:     shdr.endLoop + addr_offset(instGens, genEndloopAddrsOffset, genEndloopAddrsCoarseOffset),
+		SampleRate:  shdr.sampleRate,
+		LoopForever: sampleModes == 1 || sampleModes == 3,
+
+		DelayVolEnv:   int(instGens[genDelayVolEnv]),
+		AttackVolEnv:  int(instGens[genAttackVolEnv]),
+		HoldVolEnv:    int(instGens[genHoldVolEnv]),
+		DecayVolEnv:   int(instGens[genDecayVolEnv]),
+		SustainVolEnv: int(instGens[genSustainVolEnv]),
+		ReleaseVolEnv: int(instGens[genReleaseVolEnv]),
+	}
+}
+
+// addr_offset combines a fine (sample frame) and coarse (32768 frame units) generator pair into
+// the single signed offset the SF2 spec defines them as.
+
+func addr_offset(gens genMap, fineOp, coarseOp uint16) uint32 {
+	return uint32(int32(gens[fineOp]) + int32(gens[coarseOp])*32768)
+}
+
+// range_gen decodes a keyRange/velRange generator's packed lo/hi bytes.
+
+func range_gen(gens genMap, oper uint16) (lo, hi int, ok bool) {
+	v, present := gens[oper]
+	if !present {
+		return 0, 0, false
+	}
+	raw := uint16(v)
+	return int(raw & 0xff), int(raw >> 8), true
+}
+
+func range_gen_or_default(gens genMap, oper uint16, defLo, defHi int) (int, int) {
+	if lo, hi, ok := range_gen(gens, oper); ok {
+		return lo, hi
+	}
+	return defLo, defHi
+}
+
+func intersect_range(lo1, hi1, lo2, hi2 int) (int, int) {
+	lo := lo1
+	if lo2 > lo {
+		lo = lo2
+	}
+	hi := hi1
+	if hi2 < hi {
+		hi = hi2
+	}
+	return lo, hi
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fohristiwhirl/mod_to_wav/soundfont"
+	"github.com/fohristiwhirl/mod_to_wav/tracker"
+)
+
+// apply_soundfont replaces the modfile's own samples with ones sourced from an SF2 SoundFont, per
+// the "modSample:bank/preset" pairs in mapping (e.g. "1:0/24,2:0/38"). Each replacement keeps the
+// SF2 zone's own loop points instead of the mod's, and is tuned via the zone's root key and fine
+// tune rather than the mod sample's own (now irrelevant) finetune byte.
+
+func apply_soundfont(modfile *tracker.Modfile, path string, mapping string) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("apply_soundfont: %v", err)
+	}
+	defer f.Close()
+
+	sf, err := soundfont.Load(f)
+	if err != nil {
+		return fmt.Errorf("apply_soundfont: %v", err)
+	}
+
+	for _, entry := range strings.Split(mapping, ",") {
+
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		modSample, bank, program, err := parse_sf2_mapping_entry(entry)
+		if err != nil {
+			return fmt.Errorf("apply_soundfont: %v", err)
+		}
+
+		if modSample <= 0 || modSample >= len(modfile.Samples) {
+			return fmt.Errorf("apply_soundfont: mod sample index %d out of range", modSample)
+		}
+
+		preset, ok := sf.FindPreset(bank, program)
+		if !ok {
+			return fmt.Errorf("apply_soundfont: no preset at bank %d program %d", bank, program)
+		}
+
+		pcm, err := sf.LoadSamplesForPreset(preset)
+		if err != nil {
+			return fmt.Errorf("apply_soundfont: %v", err)
+		}
+
+		zones := sf.Presets[preset].Zones
+		if len(zones) == 0 {
+			return fmt.Errorf("apply_soundfont: preset at bank %d program %d has no playable zones", bank, program)
+		}
+
+		modfile.Samples[modSample] = sample_from_sf2_zone(zones[0], pcm[zones[0].SampleID])
+	}
+
+	return nil
+}
+
+func parse_sf2_mapping_entry(entry string) (modSample, bank, program int, err error) {
+
+	parts := strings.SplitN(entry, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, 0, fmt.Errorf("malformed mapping entry %q (want modSample:bank/preset)", entry)
+	}
+
+	modSample, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("malformed mod sample index in %q: %v", entry, err)
+	}
+
+	bankProgram := strings.SplitN(parts[1], "/", 2)
+	if len(bankProgram) != 2 {
+		return 0, 0, 0, fmt.Errorf("malformed bank/preset in %q (want bank/preset)", entry)
+	}
+
+	bank, err = strconv.Atoi(bankProgram[0])
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("malformed bank in %q: %v", entry, err)
+	}
+
+	program, err = strconv.Atoi(bankProgram[1])
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("malformed preset number in %q: %v", entry, err)
+	}
+
+	return modSample, bank, program, nil
+}
+
+// sample_from_sf2_zone builds a tracker.Sample backed by an SF2 zone's own PCM and loop points.
+// The PCM is left at its native rate; the zone's root key and fine tune are instead folded into
+// Sample.PeriodScale, which corrects the period the Mixer actually reads the data at, so the
+// existing period-based pitching machinery plays it at the right pitch despite the rate mismatch
+// between an SF2 sample (typically 44100Hz) and the Amiga's implicit 8363Hz middle-C rate.
+
+func sample_from_sf2_zone(zone soundfont.Zone, pcm []int16) *tracker.Sample {
+
+	sample := tracker.NewSample()
+
+	sample.Name = zone.SampleName
+	sample.BitsPerSample = 16
+	sample.Volume = attenuation_to_volume(zone.Attenuation)
+	sample.PeriodScale = 8363.0 / equivalent_middle_c_rate(zone)
+
+	sample.Data = pcm
+	sample.Length = len(pcm)
+
+	if zone.LoopForever && zone.LoopEnd > zone.LoopStart && zone.LoopStart >= zone.SampleStart {
+		sample.LoopType = tracker.LoopForward
+		sample.RepOffset = int(zone.LoopStart - zone.SampleStart)
+		sample.RepLength = int(zone.LoopEnd - zone.LoopStart)
+	}
+
+	return sample
+}
+
+// equivalent_middle_c_rate returns the sample rate at which zone's PCM would need to be read for
+// its root key (and fine tune) to sound like middle C.
+
+func equivalent_middle_c_rate(zone soundfont.Zone) float64 {
+	semitones := float64(zone.RootKey-60) + float64(zone.FineTune)/100.0
+	return float64(zone.SampleRate) / math.Pow(2, semitones/12.0)
+}
+
+// attenuation_to_volume converts SF2 centibels of attenuation (0 = full volume) onto the MOD
+// engine's 0-64 volume scale, treating 96dB (960cb) of attenuation as silence.
+
+func attenuation_to_volume(centibels int) int {
+	volume := 64 - int(float64(centibels)/960.0*64.0)
+	if volume < 0 {
+		return 0
+	}
+	if volume > 64 {
+		return 64
+	}
+	return volume
+}
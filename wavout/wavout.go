@@ -0,0 +1,210 @@
+// Package wavout writes WAV files with a configurable sample rate, channel count and bit depth,
+// streaming frames straight to an underlying io.WriteSeeker rather than buffering the whole file
+// in memory first (unlike wavmaker.WAV, which is always 16-bit stereo). It supports 8-bit
+// unsigned, 16-bit signed and 24-bit signed PCM, plus 32-bit IEEE float (AudioFormat 3), with a
+// correctly sized fmt chunk - and a fact chunk, as required for the non-PCM float format.
+
+package wavout
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	FormatPCM	uint16 = 1
+	FormatFloat	uint16 = 3
+)
+
+// Header describes a WAV file's audio format. AudioFormat is set by NewWriter from
+// BitsPerSample, so callers need not fill it in themselves.
+
+type Header struct {
+	NumChannels		uint16
+	SampleRate		uint32
+	BitsPerSample	uint16
+	AudioFormat		uint16
+}
+
+// Writer streams PCM frames to an underlying io.WriteSeeker. The RIFF, fmt (and, for float
+// output, fact) and data chunk headers are written immediately by NewWriter with placeholder
+// sizes; Close patches those sizes in once the final frame count is known.
+
+type Writer struct {
+	w				io.WriteSeeker
+	header			Header
+	frames			uint32
+	riffSizeOffset	int64
+	factSizeOffset	int64		// -1 if there is no fact chunk.
+	dataSizeOffset	int64
+}
+
+// NewWriter validates header.BitsPerSample (8, 16, 24 or 32; 32 implies float output) and writes
+// out the file's header chunks, ready for WriteFrame to stream sample data to w.
+
+func NewWriter(w io.WriteSeeker, header Header) (*Writer, error) {
+
+	if header.NumChannels == 0 {
+		return nil, fmt.Errorf("wavout.NewWriter: NumChannels must be at least 1")
+	}
+
+	switch header.BitsPerSample {
+	case 8, 16, 24:
+		header.AudioFormat = FormatPCM
+	case 32:
+		header.AudioFormat = FormatFloat
+	default:
+		return nil, fmt.Errorf("wavout.NewWriter: unsupported bits per sample %v", header.BitsPerSample)
+	}
+
+	self := &Writer{w: w, header: header}
+
+	err := self.write_headers()
+	if err != nil {
+		return nil, fmt.Errorf("wavout.NewWriter: %v", err)
+	}
+
+	return self, nil
+}
+
+func (self *Writer) block_align() uint16 {
+	return self.header.NumChannels * (self.header.BitsPerSample / 8)
+}
+
+func (self *Writer) write_headers() error {
+
+	bo := binary.LittleEndian
+
+	has_fact := self.header.AudioFormat != FormatPCM
+
+	fmt_chunk_size := uint32(16)
+	if has_fact {
+		fmt_chunk_size = 18		// cbSize present (and zero) for the non-PCM float format.
+	}
+
+	byte_rate := self.header.SampleRate * uint32(self.block_align())
+
+	binary.Write(self.w, bo, []byte("RIFF"))
+	self.riffSizeOffset = 4
+	binary.Write(self.w, bo, uint32(0))		// Total size, patched by Close.
+	binary.Write(self.w, bo, []byte("WAVE"))
+
+	binary.Write(self.w, bo, []byte("fmt "))
+	binary.Write(self.w, bo, fmt_chunk_size)
+	binary.Write(self.w, bo, self.header.AudioFormat)
+	binary.Write(self.w, bo, self.header.NumChannels)
+	binary.Write(self.w, bo, self.header.SampleRate)
+	binary.Write(self.w, bo, byte_rate)
+	binary.Write(self.w, bo, self.block_align())
+	binary.Write(self.w, bo, self.header.BitsPerSample)
+	if has_fact {
+		binary.Write(self.w, bo, uint16(0))		// cbSize
+	}
+
+	self.factSizeOffset = -1
+
+	if has_fact {
+		binary.Write(self.w, bo, []byte("fact"))
+		binary.Write(self.w, bo, uint32(4))
+		self.factSizeOffset = 12 + 8 + int64(fmt_chunk_size) + 8
+		binary.Write(self.w, bo, uint32(0))		// Sample count, patched by Close.
+	}
+
+	binary.Write(self.w, bo, []byte("data"))
+	self.dataSizeOffset = 12 + 8 + int64(fmt_chunk_size)
+	if has_fact {
+		self.dataSizeOffset += 8 + 4
+	}
+	self.dataSizeOffset += 4
+	binary.Write(self.w, bo, uint32(0))		// Data size, patched by Close.
+
+	return nil
+}
+
+// WriteFrame writes one frame of samples, each expected in the range -1.0 to 1.0 (values outside
+// that range are clamped), converting to the Writer's configured bit depth. len(samples) must
+// equal the Header's NumChannels.
+
+func (self *Writer) WriteFrame(samples ...float64) error {
+
+	if len(samples) != int(self.header.NumChannels) {
+		return fmt.Errorf("wavout.WriteFrame: expected %v channel(s), got %v", self.header.NumChannels, len(samples))
+	}
+
+	bo := binary.LittleEndian
+
+	for _, sample := range samples {
+
+		sample = clamp(sample, -1, 1)
+
+		switch self.header.BitsPerSample {
+
+		case 8:
+			binary.Write(self.w, bo, uint8(sample * 127.5 + 127.5))
+
+		case 16:
+			binary.Write(self.w, bo, int16(sample*32767))
+
+		case 24:
+			val := int32(sample * 8388607)
+			self.w.Write([]byte{byte(val), byte(val >> 8), byte(val >> 16)})
+
+		case 32:
+			binary.Write(self.w, bo, float32(sample))
+		}
+	}
+
+	self.frames++
+
+	return nil
+}
+
+func clamp(val, lo, hi float64) float64 {
+	if val < lo {
+		return lo
+	}
+	if val > hi {
+		return hi
+	}
+	return val
+}
+
+// Close patches the RIFF, data and (if present) fact chunk sizes now that the final frame count
+// is known. The Writer must not be used again afterwards.
+
+func (self *Writer) Close() error {
+
+	bo := binary.LittleEndian
+
+	data_size := self.frames * uint32(self.block_align())
+	riff_size := uint32(self.dataSizeOffset) - 4 + data_size		// - 4 for the "data" tag preceding dataSizeOffset.
+
+	patches := []struct {
+		offset	int64
+		value	uint32
+	}{
+		{self.riffSizeOffset, riff_size},
+		{self.dataSizeOffset, data_size},
+	}
+
+	if self.factSizeOffset >= 0 {
+		patches = append(patches, struct {
+			offset	int64
+			value	uint32
+		}{self.factSizeOffset, self.frames})
+	}
+
+	for _, patch := range patches {
+		_, err := self.w.Seek(patch.offset, io.SeekStart)
+		if err != nil {
+			return fmt.Errorf("wavout.Close: %v", err)
+		}
+		err = binary.Write(self.w, bo, patch.value)
+		if err != nil {
+			return fmt.Errorf("wavout.Close: %v", err)
+		}
+	}
+
+	return nil
+}
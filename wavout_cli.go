@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+
+	"github.com/fohristiwhirl/mod_to_wav/wavout"
+	w "github.com/fohristiwhirl/wavmaker"
+)
+
+// save_wav writes wav to path through the wavout package rather than wavmaker's own (fixed
+// 44100 Hz 16-bit stereo) Save, so that -rate, -bits and -channels can change what actually lands
+// on disk. Resampling to rate uses the same linear interpolation as wavmaker.WAV.Stretched;
+// channels == 1 downmixes left and right by averaging.
+
+func save_wav(wav *w.WAV, path string, rate, bits, channels int) error {
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	writer, err := wavout.NewWriter(f, wavout.Header{
+		NumChannels:   uint16(channels),
+		SampleRate:    uint32(rate),
+		BitsPerSample: uint16(bits),
+	})
+	if err != nil {
+		return err
+	}
+
+	source_frames := wav.FrameCount()
+	source_rate := wav.FmtChunk.SampleRate
+
+	out_frames := uint32(uint64(source_frames) * uint64(rate) / uint64(source_rate))
+
+	for n := uint32(0); n < out_frames; n++ {
+
+		source_index_f := float64(n) * float64(source_rate) / float64(rate)
+		index := uint32(source_index_f)
+		fraction := source_index_f - float64(index)
+
+		left, right := interpolated_frame(wav, index, fraction)
+
+		if channels == 1 {
+			mono := (float64(left) + float64(right)) / 2
+			err = writer.WriteFrame(mono / 32768)
+		} else {
+			err = writer.WriteFrame(float64(left)/32768, float64(right)/32768)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return writer.Close()
+}
+
+func interpolated_frame(wav *w.WAV, index uint32, fraction float64) (left, right float64) {
+
+	left_a, right_a := wav.Get(index)
+
+	if fraction == 0 || index+1 >= wav.FrameCount() {
+		return float64(left_a), float64(right_a)
+	}
+
+	left_b, right_b := wav.Get(index + 1)
+
+	left = float64(left_a) + (float64(left_b)-float64(left_a))*fraction
+	right = float64(right_a) + (float64(right_b)-float64(right_a))*fraction
+
+	return left, right
+}